@@ -80,7 +80,11 @@ type EventSubscriber interface {
 	ID() string
 
 	// BitswapMessageReceived handles a Bitswap message that was recorded by the
-	// monitor.
+	// monitor. It is called for every recorded message, for every subscriber,
+	// regardless of whether that subscriber has any sessions open: opening a
+	// session only adds session-scoped deliveries via
+	// BitswapMessageReceivedForSession, it does not switch the subscriber out
+	// of the firehose.
 	// This must not block.
 	BitswapMessageReceived(timestamp time.Time, peer peer.ID, msg BitswapMessage) error
 
@@ -88,24 +92,268 @@ type EventSubscriber interface {
 	// the monitor.
 	// This must not block.
 	ConnectionEventRecorded(timestamp time.Time, peer peer.ID, connEvent ConnectionEvent) error
+
+	// BitswapMessageReceivedForSession handles a Bitswap message that
+	// intersects the interest set of one of this subscriber's open sessions.
+	// sessionID identifies which of the subscriber's sessions matched; if a
+	// message intersects more than one of the subscriber's open sessions,
+	// this is called once per matching session. A message that matches none
+	// of the subscriber's open sessions is not delivered through this method
+	// at all (it is not dropped outright: the subscriber still sees it via
+	// BitswapMessageReceived, same as a subscriber with no sessions open).
+	// Subscribers that never open a session simply never have this method
+	// called.
+	// This must not block.
+	BitswapMessageReceivedForSession(sessionID string, timestamp time.Time, peer peer.ID, msg BitswapMessage) error
+
+	// BlockProvenanceRecorded handles a newly recorded BlockProvenanceRecord.
+	// This must not block.
+	BlockProvenanceRecorded(record BlockProvenanceRecord) error
+}
+
+// A BlockProvenanceRecord ties a block received via Bitswap back to the peer
+// that supplied it.
+type BlockProvenanceRecord struct {
+	// Cid is the block's CID.
+	Cid cid.Cid `json:"cid"`
+
+	// From is the peer the block was received from.
+	From peer.ID `json:"from"`
+
+	// ConnectedAddresses are the underlay addresses of the peer we were
+	// connected to when the block was received.
+	ConnectedAddresses []ma.Multiaddr `json:"connected_addresses"`
+
+	// ReceivedAt is the wall-clock time the block was received.
+	ReceivedAt time.Time `json:"received_at"`
+
+	// Solicited indicates whether the block arrived in response to a
+	// locally-issued WANT.
+	Solicited bool `json:"solicited"`
+
+	// Session is the ID of the session that issued the WANT this block is a
+	// response to, if session tracking is enabled and Solicited is true.
+	Session string `json:"session,omitempty"`
+
+	// LatencyFromWantMillis is the time between issuing the WANT for this
+	// CID and receiving the block, in milliseconds. Only set if Solicited is
+	// true.
+	LatencyFromWantMillis int64 `json:"latency_from_want_millis,omitempty"`
 }
 
 // ErrAlreadySubscribed is returned by Subscribe if the given EventSubscriber is
 // already subscribed.
 var ErrAlreadySubscribed = errors.New("already subscribed")
 
+// ErrSessionAlreadyOpen is returned by OpenSession if a session with the
+// given ID is already open for the given subscriber with a different
+// interest set. Re-opening a session with the same ID and the same interest
+// set is a no-op and does not return this error.
+var ErrSessionAlreadyOpen = errors.New("session already open")
+
+// ErrUnknownSession is returned by AddInterest, RemoveInterest and
+// CloseSession if no session with the given ID is open for the given
+// subscriber.
+var ErrUnknownSession = errors.New("unknown session")
+
+// EventType identifies a class of event delivered to an EventSubscriber. It
+// is used as a bit mask in SubscribeOptions.EventMask.
+type EventType int
+
+// Event type constants, usable as a bit mask.
+const (
+	// EventBitswapMessage covers BitswapMessageReceived and
+	// BitswapMessageReceivedForSession deliveries.
+	EventBitswapMessage EventType = 1 << iota
+	// EventConnection covers ConnectionEventRecorded deliveries.
+	EventConnection
+	// EventBlockProvenance covers BlockProvenanceRecorded deliveries.
+	EventBlockProvenance
+)
+
+// OverflowPolicy determines what happens when a subscriber's delivery queue
+// is full.
+type OverflowPolicy int
+
+// Overflow policy constants.
+const (
+	// DropOldest discards the oldest queued event to make room for the new
+	// one.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the incoming event instead of queuing it.
+	DropNewest
+	// Block blocks the delivering goroutine until the queue has room. This
+	// can slow down or stall message processing for the whole monitor and
+	// should be used with caution.
+	Block
+	// Disconnect unsubscribes the subscriber once its queue is full. This is
+	// the policy used by Subscribe.
+	Disconnect
+)
+
+// SubscribeOptions configures the per-subscriber delivery queue and event
+// filtering used by SubscribeWithOptions.
+type SubscribeOptions struct {
+	// QueueSize is the number of events buffered for this subscriber before
+	// OverflowPolicy takes effect.
+	QueueSize int
+
+	// OverflowPolicy determines what happens once the queue is full.
+	OverflowPolicy OverflowPolicy
+
+	// EventMask restricts delivery to the given event types. A zero value
+	// delivers every event type.
+	EventMask EventType
+
+	// PeerAllowList, if non-empty, restricts delivery to events concerning
+	// one of the given peers.
+	PeerAllowList []peer.ID
+
+	// PeerDenyList suppresses delivery of events concerning one of the given
+	// peers. It is applied after PeerAllowList.
+	PeerDenyList []peer.ID
+}
+
+// EnvelopeVersion is the current version of the Envelope wire format served
+// over the TCP pubsub mechanism. It is sent as Envelope.V in every Envelope
+// so that future incompatible changes can be told apart on the wire. The
+// handshake does not carry or negotiate it.
+const EnvelopeVersion = 1
+
+// WireEncoding identifies a content-encoding for the TCP pubsub connection,
+// negotiated between client and server as part of the handshake.
+type WireEncoding string
+
+// Wire encoding constants.
+const (
+	// EncodingNDJSON is line-delimited JSON. It is the default encoding and
+	// is human-debuggable.
+	EncodingNDJSON WireEncoding = "ndjson"
+	// EncodingCBOR is length-prefixed CBOR. It is roughly 3-5x more compact
+	// than EncodingNDJSON for typical Bitswap traffic full of CIDs and
+	// multiaddrs.
+	EncodingCBOR WireEncoding = "cbor"
+)
+
+// EnvelopeType identifies the kind of payload carried by an Envelope.
+type EnvelopeType string
+
+// Envelope type constants.
+const (
+	EnvelopeBitswapMessage  EnvelopeType = "bitswap_message"
+	EnvelopeConnectionEvent EnvelopeType = "connection_event"
+	EnvelopeBlockProvenance EnvelopeType = "block_provenance"
+)
+
+// An Envelope is the versioned wrapper sent for every event delivered over
+// the TCP pubsub connection, in either EncodingNDJSON or EncodingCBOR.
+// Payload holds a BitswapMessage, ConnectionEvent or BlockProvenanceRecord,
+// depending on Type.
+//
+// Payload is deliberately left as interface{} rather than json.RawMessage:
+// the marshaling encoder (JSON or CBOR) encodes it natively as part of the
+// Envelope, so a CBOR connection gets the compact CBOR representation of the
+// CIDs, multiaddrs and wantlists it carries instead of nested pre-serialized
+// JSON text. Encoding is not sent on the wire (it is implied by the
+// connection's negotiated encoding); the client package sets it locally so
+// callers know which decoder produced Payload's raw form.
+type Envelope struct {
+	V        int          `json:"v" cbor:"v"`
+	Type     EnvelopeType `json:"type" cbor:"type"`
+	Seq      uint64       `json:"seq" cbor:"seq"`
+	Ts       time.Time    `json:"ts" cbor:"ts"`
+	Peer     peer.ID      `json:"peer" cbor:"peer"`
+	Payload  interface{}  `json:"payload" cbor:"payload"`
+	Encoding WireEncoding `json:"-" cbor:"-"`
+}
+
+// ClientHandshake is the first frame a client sends after connecting, before
+// any Envelope is exchanged.
+type ClientHandshake struct {
+	ClientName           string         `json:"client_name" cbor:"client_name"`
+	ClientVersion        string         `json:"client_version" cbor:"client_version"`
+	AcceptedEncodings    []WireEncoding `json:"accepted_encodings" cbor:"accepted_encodings"`
+	SubscribedEventTypes []EnvelopeType `json:"subscribed_event_types" cbor:"subscribed_event_types"`
+}
+
+// ServerHandshake is sent by the monitor in response to a ClientHandshake,
+// completing the handshake.
+type ServerHandshake struct {
+	ServerVersion  string       `json:"server_version" cbor:"server_version"`
+	ChosenEncoding WireEncoding `json:"chosen_encoding" cbor:"chosen_encoding"`
+	NodePeerID     peer.ID      `json:"node_peer_id" cbor:"node_peer_id"`
+}
+
 // The MonitoringAPI encompasses methods related to monitoring Bitswap traffic.
-// These are served via the TCP pubsub mechanism.
+// These are served via the TCP pubsub mechanism, using the versioned
+// Envelope wire format described above. See metricplugin/client for a Go
+// client implementing the handshake and framing.
 type MonitoringAPI interface {
 	// Subscribe adds a subscriber to the event subscription service.
 	// Returns ErrAlreadySubscribed if the given subscriber is already subscribed.
 	// An EventSubscriber that returns an error on one of the notification
 	// methods will be removed from the list of subscribers.
+	//
+	// Subscribe is a thin wrapper around SubscribeWithOptions using a small
+	// queue and the Disconnect overflow policy, matching the behaviour of
+	// earlier versions of this API.
 	Subscribe(subscriber EventSubscriber) error
 
+	// SubscribeWithOptions adds a subscriber to the event subscription
+	// service the same way Subscribe does, but lets the caller control the
+	// per-subscriber delivery queue and filtering via opts.
+	// Returns ErrAlreadySubscribed if the given subscriber is already
+	// subscribed.
+	//
+	// Implementations must buffer each subscriber independently up to
+	// opts.QueueSize and apply opts.OverflowPolicy once that queue is full,
+	// so that one slow subscriber cannot stall delivery to the others.
+	// Implementations are expected to expose per-subscriber queue depth and
+	// drop counts as Prometheus metrics (named me_subscriber_queue_depth and
+	// me_subscriber_events_dropped_total{subscriber_id,event_type} in this
+	// plugin) so operators can see a subscriber falling behind.
+	SubscribeWithOptions(subscriber EventSubscriber, opts SubscribeOptions) error
+
 	// Unsubscribe removes a subscriber from the event subscription service.
 	// It is safe to call this multiple times with the same subscriber.
+	// Unsubscribe also closes every session the subscriber has open, as if
+	// CloseSession had been called for each of them; it is not necessary
+	// (and not possible, since the subscriber is no longer known) to close
+	// sessions individually first.
 	Unsubscribe(subscriber EventSubscriber)
+
+	// OpenSession opens a new logical session for the given subscriber,
+	// scoping future session-based message dispatch to the given CIDs of
+	// interest. OpenSession is idempotent for identical calls: opening a
+	// sessionID that is already open for the subscriber with the same
+	// interest set is a no-op.
+	// Returns ErrSessionAlreadyOpen if a session with the same sessionID is
+	// already open for the subscriber with a different interest set; use
+	// AddInterest/RemoveInterest to change it instead.
+	OpenSession(subscriber EventSubscriber, sessionID string, cids []cid.Cid) error
+
+	// AddInterest adds the given CIDs to the interest set of an already-open
+	// session.
+	// Returns ErrUnknownSession if no such session is open for the
+	// subscriber.
+	// The update is atomic with respect to concurrent message dispatch: a
+	// message is matched against either the interest set from before the
+	// call or the one after it, never a partially-updated set.
+	AddInterest(subscriber EventSubscriber, sessionID string, cids []cid.Cid) error
+
+	// RemoveInterest removes the given CIDs from the interest set of an
+	// already-open session.
+	// Returns ErrUnknownSession if no such session is open for the
+	// subscriber.
+	// The update is atomic with respect to concurrent message dispatch: a
+	// message is matched against either the interest set from before the
+	// call or the one after it, never a partially-updated set.
+	RemoveInterest(subscriber EventSubscriber, sessionID string, cids []cid.Cid) error
+
+	// CloseSession closes a previously opened session, releasing its
+	// interest set. It is safe to call this multiple times with the same
+	// sessionID; calls after the first return ErrUnknownSession.
+	CloseSession(subscriber EventSubscriber, sessionID string) error
 }
 
 // The RPCAPI is the interface for RPC-like method calls.
@@ -134,6 +382,30 @@ type RPCAPI interface {
 	// given CIDs, followed by CANCEL entries after a given time to all
 	// connected peers that support Bitswap.
 	BroadcastBitswapWantCancel(cids []cid.Cid, secondsBetween uint) []BroadcastWantCancelStatus
+
+	// GetBlockProvenance returns the recorded BlockProvenanceRecord for each
+	// of the given CIDs for which one is known. CIDs for which no block has
+	// been recorded are omitted from the result.
+	GetBlockProvenance(cids []cid.Cid) []BlockProvenanceRecord
+
+	// SendBitswapWant sends WANT requests of the given wantType for the
+	// given CIDs to exactly the given peers, as one message per peer.
+	// Peers we are not currently connected to are dialed first, with a
+	// per-call timeout; the dial outcome is reported in the returned status.
+	SendBitswapWant(peers []peer.ID, cids []cid.Cid, wantType pbmsg.Message_Wantlist_WantType) []SendWantStatus
+
+	// SendBitswapCancel sends CANCEL entries for the given CIDs to exactly
+	// the given peers, as one message per peer. Peers we are not currently
+	// connected to are dialed first, with a per-call timeout; the dial
+	// outcome is reported in the returned status.
+	SendBitswapCancel(peers []peer.ID, cids []cid.Cid) []SendCancelStatus
+
+	// SendBitswapWantCancel sends WANT requests of the given wantType for
+	// the given CIDs to exactly the given peers, followed by CANCEL entries
+	// after a given time. Peers we are not currently connected to are dialed
+	// first, with a per-call timeout; the dial outcome is reported in the
+	// returned status.
+	SendBitswapWantCancel(peers []peer.ID, cids []cid.Cid, wantType pbmsg.Message_Wantlist_WantType, secondsBetween uint) []SendWantCancelStatus
 }
 
 // PluginAPI describes the functionality provided by this monitor to remote
@@ -191,3 +463,41 @@ type BroadcastWantCancelStatus struct {
 	WantStatus   BroadcastWantCancelWantStatus `json:"want_status"`
 	CancelStatus BroadcastSendStatus           `json:"cancel_status"`
 }
+
+// SendStatus contains basic information about a send operation to a single,
+// explicitly targeted peer as part of a Bitswap Send* call. It extends
+// BroadcastStatus with the outcome of a dial attempt, since targeted sends
+// may address peers we are not yet connected to.
+type SendStatus struct {
+	BroadcastStatus
+	// DialAttempted indicates whether the peer had to be dialed because we
+	// were not already connected to it.
+	DialAttempted bool `json:"dial_attempted"`
+	// DialError is set if DialAttempted is true and the dial failed.
+	DialError error `json:"dial_error,omitempty"`
+}
+
+// SendWantStatus describes the status of a send operation to a single,
+// explicitly targeted peer as part of a Bitswap SendBitswapWant call.
+type SendWantStatus struct {
+	SendStatus
+	RequestTypeSent *pbmsg.Message_Wantlist_WantType `json:"request_type_sent,omitempty"`
+}
+
+// SendCancelStatus describes the status of a send operation to a single,
+// explicitly targeted peer as part of a Bitswap SendBitswapCancel call.
+type SendCancelStatus struct {
+	SendStatus
+}
+
+// SendWantCancelStatus describes the status of a send operation to a single,
+// explicitly targeted peer as part of a Bitswap SendBitswapWantCancel call.
+type SendWantCancelStatus struct {
+	Peer               peer.ID        `json:"peer"`
+	ConnectedAddresses []ma.Multiaddr `json:"connected_addresses,omitempty"`
+	DialAttempted      bool           `json:"dial_attempted"`
+	DialError          error          `json:"dial_error,omitempty"`
+
+	WantStatus   BroadcastWantCancelWantStatus `json:"want_status"`
+	CancelStatus BroadcastSendStatus           `json:"cancel_status"`
+}
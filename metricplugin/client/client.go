@@ -0,0 +1,378 @@
+// Package client implements a Go client for the MonitoringAPI TCP pubsub
+// wire format described by metricplugin.Envelope: handshake negotiation,
+// framed NDJSON/CBOR decoding, and automatic reconnect with sequence-number
+// gap detection, so downstream tools don't have to reimplement it.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	logger "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/peer"
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/pkg/errors"
+
+	"meplugin/metricplugin"
+)
+
+var log = logger.Logger("metricplugin/client")
+
+// ErrEncodingNotAccepted is returned by Dial if the server chose an encoding
+// not listed in Options.AcceptedEncodings.
+var ErrEncodingNotAccepted = errors.New("server did not choose an accepted encoding")
+
+// Options configures a Client.
+type Options struct {
+	// ClientName and ClientVersion identify this client in the handshake.
+	ClientName    string
+	ClientVersion string
+
+	// AcceptedEncodings lists the wire encodings this client can decode, in
+	// order of preference. Defaults to
+	// []metricplugin.WireEncoding{EncodingNDJSON, EncodingCBOR}.
+	AcceptedEncodings []metricplugin.WireEncoding
+
+	// SubscribedEventTypes restricts the server to sending only the given
+	// event types. A nil slice subscribes to all event types.
+	SubscribedEventTypes []metricplugin.EnvelopeType
+
+	// ReconnectBackoff is the delay between reconnect attempts after the
+	// connection is lost. Defaults to one second.
+	ReconnectBackoff time.Duration
+
+	// HandshakeTimeout bounds how long Dial and each reconnect attempt wait
+	// for the handshake to complete. Defaults to ten seconds.
+	HandshakeTimeout time.Duration
+
+	// OnGap, if set, is called whenever a gap is detected in the server's
+	// Envelope sequence numbers, instead of the default behaviour of
+	// logging a warning.
+	OnGap func(expectedSeq, gotSeq uint64)
+}
+
+func (o *Options) setDefaults() {
+	if len(o.AcceptedEncodings) == 0 {
+		o.AcceptedEncodings = []metricplugin.WireEncoding{metricplugin.EncodingNDJSON, metricplugin.EncodingCBOR}
+	}
+	if o.ReconnectBackoff <= 0 {
+		o.ReconnectBackoff = time.Second
+	}
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = 10 * time.Second
+	}
+}
+
+// A Client consumes Envelopes from a MonitoringAPI TCP pubsub endpoint. It
+// reconnects automatically on connection loss and detects gaps in the
+// server's sequence numbers.
+type Client struct {
+	addr string
+	opts Options
+
+	events chan metricplugin.Envelope
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	connMu sync.Mutex
+	conn   net.Conn
+
+	lastSeq uint64
+	haveSeq bool
+}
+
+// Dial connects to the given MonitoringAPI TCP pubsub address, performs the
+// handshake, and starts a background goroutine that decodes Envelopes and
+// transparently reconnects on failure. Call Events to consume the decoded
+// Envelopes and Close to stop the Client.
+func Dial(addr string, opts Options) (*Client, error) {
+	opts.setDefaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		addr:   addr,
+		opts:   opts,
+		events: make(chan metricplugin.Envelope, 64),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	conn, encoding, err := c.connectOnce()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.setConn(conn)
+
+	go c.readLoop(conn, encoding)
+
+	return c, nil
+}
+
+// Events returns the channel Envelopes are delivered on. It is closed once
+// the Client is closed.
+func (c *Client) Events() <-chan metricplugin.Envelope {
+	return c.events
+}
+
+// Close stops the Client's background goroutine and releases its
+// connection, including unblocking a read that is currently in flight.
+func (c *Client) Close() {
+	c.cancel()
+	c.connMu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.connMu.Unlock()
+}
+
+// setConn records conn as the Client's current connection, unless the
+// Client has already been closed, in which case conn is closed immediately.
+// This prevents a connection established by a reconnect racing with Close
+// from being left open and un-tracked.
+func (c *Client) setConn(conn net.Conn) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	select {
+	case <-c.ctx.Done():
+		conn.Close()
+		return
+	default:
+	}
+	c.conn = conn
+}
+
+// connectOnce dials addr and performs the handshake once, returning the
+// connection and the encoding the server chose.
+func (c *Client) connectOnce() (net.Conn, metricplugin.WireEncoding, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.opts.HandshakeTimeout)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "dialing monitoring address")
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(c.opts.HandshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, "", errors.Wrap(err, "setting handshake deadline")
+	}
+
+	hello := metricplugin.ClientHandshake{
+		ClientName:           c.opts.ClientName,
+		ClientVersion:        c.opts.ClientVersion,
+		AcceptedEncodings:    c.opts.AcceptedEncodings,
+		SubscribedEventTypes: c.opts.SubscribedEventTypes,
+	}
+	helloBytes, err := json.Marshal(hello)
+	if err != nil {
+		conn.Close()
+		return nil, "", errors.Wrap(err, "marshaling client handshake")
+	}
+	if err := msgio.NewWriter(conn).WriteMsg(helloBytes); err != nil {
+		conn.Close()
+		return nil, "", errors.Wrap(err, "sending client handshake")
+	}
+
+	serverHelloBytes, err := msgio.NewReader(conn).ReadMsg()
+	if err != nil {
+		conn.Close()
+		return nil, "", errors.Wrap(err, "reading server handshake")
+	}
+
+	var serverHello metricplugin.ServerHandshake
+	if err := json.Unmarshal(serverHelloBytes, &serverHello); err != nil {
+		conn.Close()
+		return nil, "", errors.Wrap(err, "decoding server handshake")
+	}
+
+	accepted := false
+	for _, e := range c.opts.AcceptedEncodings {
+		if e == serverHello.ChosenEncoding {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		conn.Close()
+		return nil, "", ErrEncodingNotAccepted
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, "", errors.Wrap(err, "clearing handshake deadline")
+	}
+
+	log.Infow("connected to monitoring endpoint",
+		"addr", c.addr, "encoding", serverHello.ChosenEncoding, "peer", serverHello.NodePeerID)
+
+	return conn, serverHello.ChosenEncoding, nil
+}
+
+// readLoop decodes Envelopes from conn until decoding fails, then reconnects
+// with opts.ReconnectBackoff between attempts, until the Client is closed.
+// Close unblocks a read in flight by closing conn out from under it, which
+// is why every exit path checks ctx.Done() before attempting to reconnect.
+func (c *Client) readLoop(conn net.Conn, encoding metricplugin.WireEncoding) {
+	defer close(c.events)
+
+	for {
+		err := c.decodeFrom(conn, encoding)
+		conn.Close()
+
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Warnw("monitoring connection lost", "addr", c.addr, "error", err)
+		}
+
+		var newConn net.Conn
+		var chosen metricplugin.WireEncoding
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(c.opts.ReconnectBackoff):
+			}
+
+			newConn, chosen, err = c.connectOnce()
+			if err == nil {
+				break
+			}
+			log.Warnw("reconnect failed", "addr", c.addr, "error", err)
+		}
+		c.setConn(newConn)
+		conn, encoding = newConn, chosen
+	}
+}
+
+// decodeFrom decodes Envelopes from conn in the given encoding until
+// decoding fails or the Client is closed.
+func (c *Client) decodeFrom(conn net.Conn, encoding metricplugin.WireEncoding) error {
+	if encoding == metricplugin.EncodingCBOR {
+		return c.decodeCBOR(conn)
+	}
+	return c.decodeNDJSON(conn)
+}
+
+func (c *Client) decodeNDJSON(conn net.Conn) error {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var raw struct {
+			V       int                       `json:"v"`
+			Type    metricplugin.EnvelopeType `json:"type"`
+			Seq     uint64                    `json:"seq"`
+			Ts      time.Time                 `json:"ts"`
+			Peer    peer.ID                   `json:"peer"`
+			Payload json.RawMessage           `json:"payload"`
+		}
+		if err := dec.Decode(&raw); err != nil {
+			return errors.Wrap(err, "decoding ndjson envelope")
+		}
+
+		env := metricplugin.Envelope{
+			V:        raw.V,
+			Type:     raw.Type,
+			Seq:      raw.Seq,
+			Ts:       raw.Ts,
+			Peer:     raw.Peer,
+			Payload:  raw.Payload,
+			Encoding: metricplugin.EncodingNDJSON,
+		}
+
+		if !c.deliver(env) {
+			return nil
+		}
+	}
+}
+
+func (c *Client) decodeCBOR(conn net.Conn) error {
+	r := msgio.NewReader(conn)
+	for {
+		msg, err := r.ReadMsg()
+		if err != nil {
+			return errors.Wrap(err, "reading cbor frame")
+		}
+
+		var raw struct {
+			V       int                       `cbor:"v"`
+			Type    metricplugin.EnvelopeType `cbor:"type"`
+			Seq     uint64                    `cbor:"seq"`
+			Ts      time.Time                 `cbor:"ts"`
+			Peer    peer.ID                   `cbor:"peer"`
+			Payload cbor.RawMessage           `cbor:"payload"`
+		}
+		err = cbor.Unmarshal(msg, &raw)
+		r.ReleaseMsg(msg)
+		if err != nil {
+			return errors.Wrap(err, "decoding cbor envelope")
+		}
+
+		env := metricplugin.Envelope{
+			V:        raw.V,
+			Type:     raw.Type,
+			Seq:      raw.Seq,
+			Ts:       raw.Ts,
+			Peer:     raw.Peer,
+			Payload:  raw.Payload,
+			Encoding: metricplugin.EncodingCBOR,
+		}
+
+		if !c.deliver(env) {
+			return nil
+		}
+	}
+}
+
+// DecodePayload decodes env.Payload into out, using whichever encoding
+// produced env (env.Encoding). Payload stays in its wire-native raw form
+// until a caller knows the concrete type to decode it into (a
+// metricplugin.BitswapMessage, ConnectionEvent or BlockProvenanceRecord,
+// depending on env.Type), which is what keeps the CBOR encoding compact end
+// to end instead of smuggling JSON text through it.
+func DecodePayload(env metricplugin.Envelope, out interface{}) error {
+	switch env.Encoding {
+	case metricplugin.EncodingCBOR:
+		raw, ok := env.Payload.(cbor.RawMessage)
+		if !ok {
+			return errors.Errorf("envelope payload is %T, not cbor.RawMessage", env.Payload)
+		}
+		return cbor.Unmarshal(raw, out)
+	default:
+		raw, ok := env.Payload.(json.RawMessage)
+		if !ok {
+			return errors.Errorf("envelope payload is %T, not json.RawMessage", env.Payload)
+		}
+		return json.Unmarshal(raw, out)
+	}
+}
+
+// deliver checks env's sequence number for gaps against the last delivered
+// Envelope, pushes env onto the events channel, and reports whether the
+// Client is still running.
+func (c *Client) deliver(env metricplugin.Envelope) bool {
+	if c.haveSeq && env.Seq != c.lastSeq+1 {
+		if c.opts.OnGap != nil {
+			c.opts.OnGap(c.lastSeq+1, env.Seq)
+		} else {
+			log.Warnw("sequence gap detected", "expected", c.lastSeq+1, "got", env.Seq)
+		}
+	}
+	c.lastSeq = env.Seq
+	c.haveSeq = true
+
+	select {
+	case c.events <- env:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
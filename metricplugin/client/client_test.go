@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"meplugin/metricplugin"
+)
+
+func newTestClient() *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		events: make(chan metricplugin.Envelope, 8),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func TestDeliverGapDetection(t *testing.T) {
+	cases := []struct {
+		name    string
+		seqs    []uint64
+		wantGap bool
+	}{
+		{"contiguous", []uint64{1, 2, 3}, false},
+		{"gap", []uint64{1, 3}, true},
+		{"first envelope never flagged", []uint64{5}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient()
+			defer c.cancel()
+
+			var gotExpected, gotSeq uint64
+			var gapCalled bool
+			c.opts.OnGap = func(expected, got uint64) {
+				gapCalled = true
+				gotExpected, gotSeq = expected, got
+			}
+
+			for _, seq := range tc.seqs {
+				if !c.deliver(metricplugin.Envelope{Seq: seq}) {
+					t.Fatalf("deliver returned false unexpectedly")
+				}
+			}
+
+			if gapCalled != tc.wantGap {
+				t.Fatalf("OnGap called = %v, want %v", gapCalled, tc.wantGap)
+			}
+			if tc.wantGap {
+				last := tc.seqs[len(tc.seqs)-1]
+				if gotSeq != last || gotExpected != last-1 {
+					t.Fatalf("OnGap got (%d, %d), want expected=%d got=%d", gotExpected, gotSeq, last-1, last)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliverStopsWhenClosed(t *testing.T) {
+	c := newTestClient()
+	c.cancel()
+
+	if c.deliver(metricplugin.Envelope{Seq: 1}) {
+		t.Fatal("deliver returned true after the Client was closed")
+	}
+}
+
+type testPayload struct {
+	Foo string `json:"foo" cbor:"foo"`
+	Bar int    `json:"bar" cbor:"bar"`
+}
+
+func TestDecodePayloadNDJSONRoundTrip(t *testing.T) {
+	want := testPayload{Foo: "hello", Bar: 42}
+	raw, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("marshaling payload: %v", err)
+	}
+	env := metricplugin.Envelope{
+		Encoding: metricplugin.EncodingNDJSON,
+		Payload:  json.RawMessage(raw),
+	}
+
+	var got testPayload
+	if err := DecodePayload(env, &got); err != nil {
+		t.Fatalf("DecodePayload: %v", err)
+	}
+	if got != want {
+		t.Fatalf("DecodePayload = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodePayloadCBORRoundTrip(t *testing.T) {
+	want := testPayload{Foo: "hello", Bar: 42}
+	raw, err := cbor.Marshal(want)
+	if err != nil {
+		t.Fatalf("marshaling payload: %v", err)
+	}
+	env := metricplugin.Envelope{
+		Encoding: metricplugin.EncodingCBOR,
+		Payload:  cbor.RawMessage(raw),
+	}
+
+	var got testPayload
+	if err := DecodePayload(env, &got); err != nil {
+		t.Fatalf("DecodePayload: %v", err)
+	}
+	if got != want {
+		t.Fatalf("DecodePayload = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodePayloadWrongRawType(t *testing.T) {
+	env := metricplugin.Envelope{
+		Encoding: metricplugin.EncodingCBOR,
+		Payload:  json.RawMessage(`{}`),
+	}
+
+	var got testPayload
+	if err := DecodePayload(env, &got); err == nil {
+		t.Fatal("DecodePayload succeeded despite a mismatched raw payload type")
+	}
+}